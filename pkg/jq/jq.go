@@ -0,0 +1,1067 @@
+// Package jq is a small cgo wrapper around libjq that lets Go programs
+// compile and run jq filters against JSON input without shelling out to
+// the jq binary.
+//
+// A filter is built up with NewJq().Program(...), which can be run
+// directly, pre-compiled once for reuse, or compiled through a Cache so
+// that concurrent callers sharing the same program text, lib path,
+// builder flags and $arg bindings reuse one compiled jq_state.
+package jq
+
+/*
+#cgo pkg-config: libjq
+#include <jq.h>
+#include <jv.h>
+#include <stdlib.h>
+
+extern void goJqErrorCallback(void *data, char *msg);
+
+// jqErrorCallbackTrampoline adapts jq's jq_err_cb signature (which hands
+// back an arbitrary jv, usually but not always a string) to the Go
+// callback below, and frees the jv values it consumes along the way.
+static void jqErrorCallbackTrampoline(void *data, jv msg) {
+	jv dumped = jv_get_kind(msg) == JV_KIND_STRING ? jv_copy(msg) : jv_dump_string(jv_copy(msg), 0);
+	goJqErrorCallback(data, (char *)jv_string_value(dumped));
+	jv_free(dumped);
+	jv_free(msg);
+}
+
+// jqSetGoErrorCallback takes the cgo.Handle as a size_t rather than a
+// void* so the Go side never has to convert a bare uintptr to an
+// unsafe.Pointer itself; the cast to void* happens here, on the C side.
+static void jqSetGoErrorCallback(jq_state *jq, size_t handle) {
+	jq_set_error_cb(jq, jqErrorCallbackTrampoline, (void *)handle);
+}
+*/
+import "C"
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"runtime/cgo"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+//export goJqErrorCallback
+func goJqErrorCallback(data unsafe.Pointer, msg *C.char) {
+	prog, ok := cgo.Handle(uintptr(data)).Value().(*Program)
+	if !ok {
+		return
+	}
+	prog.errBuf = append(prog.errBuf, C.GoString(msg))
+}
+
+// Jq is a builder that accumulates the options a jq program is compiled
+// with: where to resolve `include`/`import` from, and which Cache (if
+// any) to reuse compiled programs from. Build one with NewJq.
+type Jq struct {
+	libPath     string
+	cache       *Cache
+	useNumber   bool
+	stopOnError bool
+	args        []jqArg
+}
+
+// jqArg is one $name binding accumulated by WithArg, WithArgJSON or
+// WithArgValue. json holds the value as JSON text so compile can bind
+// every arg the same way regardless of which With* method produced it;
+// WithArgJSON stores the caller's text unchecked, and buildArgs rejects
+// it there if it doesn't parse. err carries a WithArgValue marshal failure forward to
+// compile, since a builder method can't return one itself.
+type jqArg struct {
+	name string
+	json string
+	err  error
+}
+
+// NewJq returns an empty builder.
+func NewJq() *Jq {
+	return &Jq{}
+}
+
+// WithLibPath sets the directory jq's `include`/`import` directives are
+// resolved against, mirroring the jq CLI's -L flag.
+func (j *Jq) WithLibPath(path string) *Jq {
+	j.libPath = path
+	return j
+}
+
+// WithCache attaches a Cache that Cached() will use to reuse compiled
+// programs across calls. Without one, Cached() behaves like Precompile.
+func (j *Jq) WithCache(c *Cache) *Jq {
+	j.cache = c
+	return j
+}
+
+// WithUseNumber makes RunValue and RunInto decode JSON numbers in jq's
+// output as json.Number instead of float64, so large integers that jq
+// handles with arbitrary precision don't get silently truncated on the
+// way back into Go.
+func (j *Jq) WithUseNumber() *Jq {
+	j.useNumber = true
+	return j
+}
+
+// WithStopOnError makes RunLines and RunLinesFunc abort the whole batch
+// as soon as one line fails to parse or produces a runtime error.
+// Without it, a failing line is reported through RunLinesFunc's err
+// argument (or skipped by RunLines) and the rest of the batch still
+// runs.
+func (j *Jq) WithStopOnError() *Jq {
+	j.stopOnError = true
+	return j
+}
+
+// WithArg binds $name to value as a jq string for every Run on this
+// builder, mirroring the jq CLI's --arg.
+func (j *Jq) WithArg(name, value string) *Jq {
+	encoded, _ := json.Marshal(value)
+	j.args = append(j.args, jqArg{name: name, json: string(encoded)})
+	return j
+}
+
+// WithArgJSON binds $name to jsonValue, parsed as JSON rather than
+// taken as a literal string, mirroring the jq CLI's --argjson.
+func (j *Jq) WithArgJSON(name, jsonValue string) *Jq {
+	j.args = append(j.args, jqArg{name: name, json: jsonValue})
+	return j
+}
+
+// WithArgValue binds $name to v, marshaled to JSON, so a Go value can
+// be passed as a jq argument without hand-rolling the encoding/json
+// round-trip WithArgJSON would otherwise need.
+func (j *Jq) WithArgValue(name string, v interface{}) *Jq {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		j.args = append(j.args, jqArg{name: name, err: fmt.Errorf("jq: failed to marshal arg %q: %w", name, err)})
+		return j
+	}
+	j.args = append(j.args, jqArg{name: name, json: string(encoded)})
+	return j
+}
+
+// Program starts a filter. Nothing is compiled yet; compilation happens
+// on Run, Precompile, or Cached.
+func (j *Jq) Program(program string) *JqProgram {
+	return &JqProgram{jq: j, program: program}
+}
+
+// JqProgram is a builder holding the filter text plus whatever was
+// configured on the Jq it was created from.
+type JqProgram struct {
+	jq      *Jq
+	program string
+}
+
+// Run compiles the program and applies it to a single JSON input,
+// returning the first output value it produces. Any additional output
+// values the filter produces (e.g. from `.[]`) are discarded; use
+// RunAll to collect all of them.
+func (p *JqProgram) Run(input string) (string, error) {
+	prog, err := p.compile()
+	if err != nil {
+		return "", err
+	}
+	defer prog.Close()
+	return prog.Run(input)
+}
+
+// RunValue compiles the program, marshals in to JSON to use as input,
+// and unmarshals the first output value it produces back into a Go
+// value. It saves callers from hand-rolling the encoding/json
+// round-trip around Run.
+func (p *JqProgram) RunValue(in interface{}) (interface{}, error) {
+	prog, err := p.compile()
+	if err != nil {
+		return nil, err
+	}
+	defer prog.Close()
+	return prog.RunValue(in)
+}
+
+// RunInto compiles the program, marshals in to JSON to use as input,
+// and unmarshals the first output value it produces into out, which
+// must be a pointer as with json.Unmarshal.
+func (p *JqProgram) RunInto(in interface{}, out interface{}) error {
+	prog, err := p.compile()
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	return prog.RunInto(in, out)
+}
+
+// RunAll compiles the program and applies it to a single JSON input,
+// returning every output value it produces, in order.
+func (p *JqProgram) RunAll(input string) ([]string, error) {
+	prog, err := p.compile()
+	if err != nil {
+		return nil, err
+	}
+	defer prog.Close()
+	return prog.RunAll(input)
+}
+
+// RunStream compiles the program and applies it to the single JSON
+// value read from in, invoking out with each output value as it is
+// produced. in may only contain one JSON document; a reader with more
+// than one back to back fails with a parse error, same as Run.
+func (p *JqProgram) RunStream(in io.Reader, out func(result string) error) error {
+	prog, err := p.compile()
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	return prog.RunStream(in, out)
+}
+
+// RunLines compiles the program once and applies it to r, one
+// line-delimited JSON document at a time, writing every output value
+// produced for each line as its own line to w, matching `jq -c` on
+// NDJSON input. A failing line is skipped unless WithStopOnError was
+// set on the builder.
+func (p *JqProgram) RunLines(r io.Reader, w io.Writer) error {
+	prog, err := p.compile()
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	return prog.RunLines(r, w)
+}
+
+// RunLinesFunc is like RunLines, but calls fn with each line's 1-based
+// line number, output values, and error instead of writing to an
+// io.Writer, so callers can handle results however they like. fn's
+// return value, if non-nil, stops the batch early and is returned from
+// RunLinesFunc unchanged.
+func (p *JqProgram) RunLinesFunc(r io.Reader, fn func(line int, results []string, err error) error) error {
+	prog, err := p.compile()
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	return prog.RunLinesFunc(r, fn)
+}
+
+// RunContext is like Run, but stops waiting as soon as ctx is done
+// instead of blocking until the program finishes. See Program.RunContext
+// for how the running jq_state is interrupted.
+func (p *JqProgram) RunContext(ctx context.Context, input string) (string, error) {
+	prog, err := p.compile()
+	if err != nil {
+		return "", err
+	}
+	defer prog.Close()
+	return prog.RunContext(ctx, input)
+}
+
+// RunAllContext is the RunAll counterpart of RunContext.
+func (p *JqProgram) RunAllContext(ctx context.Context, input string) ([]string, error) {
+	prog, err := p.compile()
+	if err != nil {
+		return nil, err
+	}
+	defer prog.Close()
+	return prog.RunAllContext(ctx, input)
+}
+
+// Precompile compiles the program once and returns a Program that can
+// be run repeatedly without recompiling. Unlike Cached, the result is
+// never stored in a Cache, even if one was attached with WithCache.
+func (p *JqProgram) Precompile() (*Program, error) {
+	return p.compile()
+}
+
+// Cached compiles the program through the Cache attached with
+// WithCache, reusing a previous compilation when one exists for the
+// same program text, lib path, WithUseNumber/WithStopOnError flags and
+// $arg bindings (see cacheKey). Without an attached Cache, it
+// compiles a fresh, unshared Program.
+//
+// Compile errors are not returned here; they surface from the first
+// call to Run on the returned Program.
+func (p *JqProgram) Cached() *Program {
+	if p.jq.cache == nil {
+		prog, err := p.compile()
+		if err != nil {
+			return &Program{compileErr: err}
+		}
+		return prog
+	}
+	key := cacheKey(p.program, p.jq.libPath, p.jq.useNumber, p.jq.stopOnError, p.jq.args)
+	return p.jq.cache.getOrCompile(key, p.compile)
+}
+
+// cacheKey identifies a compiled Program by everything that changes its
+// behavior: program text, lib path, the useNumber/stopOnError flags,
+// and $arg bindings. Args are sorted by name first so two builders
+// that bound the same args in a different order still hit the same
+// cache entry. useNumber and stopOnError live on Program rather than
+// the compiled jq_state, but they must still be part of the key -
+// otherwise a second builder sharing a Cache with a first one that
+// didn't set them would silently get back the first builder's Program,
+// flags and all.
+func cacheKey(program, libPath string, useNumber, stopOnError bool, args []jqArg) string {
+	sorted := make([]jqArg, len(args))
+	copy(sorted, args)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	var b strings.Builder
+	b.WriteString(libPath)
+	b.WriteByte(0)
+	b.WriteString(program)
+	b.WriteByte(0)
+	fmt.Fprintf(&b, "%t\x00%t", useNumber, stopOnError)
+	for _, a := range sorted {
+		b.WriteByte(0)
+		b.WriteString(a.name)
+		b.WriteByte(0)
+		b.WriteString(a.json)
+	}
+	return b.String()
+}
+
+func (p *JqProgram) compile() (*Program, error) {
+	state := C.jq_init()
+	if state == nil {
+		return nil, fmt.Errorf("jq: failed to initialize jq state")
+	}
+
+	prog := &Program{
+		state:       state,
+		program:     p.program,
+		libPath:     p.jq.libPath,
+		useNumber:   p.jq.useNumber,
+		stopOnError: p.jq.stopOnError,
+	}
+	prog.errHandle = cgo.NewHandle(prog)
+	C.jqSetGoErrorCallback(state, C.size_t(prog.errHandle))
+	prog.setLibPath(p.jq.libPath)
+
+	cProgram := C.CString(p.program)
+	defer C.free(unsafe.Pointer(cProgram))
+
+	argsObj, err := p.jq.buildArgs(p.program)
+	if err != nil {
+		prog.Close()
+		return nil, err
+	}
+
+	if C.jq_compile_args(state, cProgram, argsObj) == 0 {
+		line, column := parseLineColumn(strings.Join(prog.errBuf, "\n"))
+		err := &JqError{
+			Kind:    JqErrorKindCompile,
+			Message: strings.Join(prog.errBuf, "\n"),
+			Program: p.program,
+			Line:    line,
+			Column:  column,
+		}
+		prog.Close()
+		return nil, err
+	}
+	prog.errBuf = nil
+
+	return prog, nil
+}
+
+// buildArgs turns the builder's accumulated WithArg/WithArgJSON/
+// WithArgValue bindings into the jv object jq_compile_args binds as
+// $name variables, parsing each binding's JSON text into a jv. program
+// is only used to populate a JqError's Program field; it consumes no
+// other state of j and may be called more than once.
+func (j *Jq) buildArgs(program string) (C.jv, error) {
+	obj := C.jv_object()
+	for _, a := range j.args {
+		if a.err != nil {
+			C.jv_free(obj)
+			return C.jv_invalid(), a.err
+		}
+
+		cJSON := C.CString(a.json)
+		value := C.jv_parse(cJSON)
+		C.free(unsafe.Pointer(cJSON))
+		if C.jv_is_valid(value) == 0 {
+			C.jv_free(value)
+			C.jv_free(obj)
+			return C.jv_invalid(), &JqError{Kind: JqErrorKindParse, Message: fmt.Sprintf("invalid JSON for arg %q: %s", a.name, a.json), Program: program}
+		}
+
+		cName := C.CString(a.name)
+		obj = C.jv_object_set(obj, C.jv_string(cName), value)
+		C.free(unsafe.Pointer(cName))
+	}
+	return obj, nil
+}
+
+// Program is a compiled jq filter, ready to run against any number of
+// JSON inputs. Programs are safe for concurrent use: each Run call
+// holds the Program's lock for the duration of the call, since a single
+// jq_state cannot evaluate two inputs at once.
+type Program struct {
+	mu          sync.Mutex
+	state       *C.jq_state
+	program     string
+	libPath     string
+	useNumber   bool
+	stopOnError bool
+
+	// haltMu guards halted and haltGen. halted mirrors whether jq_halt
+	// has already been called on state since the last jq_start reset it;
+	// jq_halt asserts the state isn't already halted and aborts the
+	// whole process if it is, so halt must check-and-set this under
+	// haltMu rather than calling jq_halt unconditionally. haltGen is
+	// bumped by resetHalted on every jq_start and captured by
+	// watchContext, so a watcher left over from a previous call - one
+	// whose stop was already called, but whose goroutine hadn't yet
+	// noticed before a new call reused this same cached Program - can
+	// tell its jq_start is stale and refuse to halt the new call's
+	// jq_state instead.
+	haltMu  sync.Mutex
+	halted  bool
+	haltGen uint64
+
+	// compileErr is set when Cached() was asked to hand back a Program
+	// whose compilation failed; Run reports it instead of touching a
+	// nil state.
+	compileErr error
+
+	// errHandle pins this Program so jqErrorCallbackTrampoline can find
+	// it again from the void* data pointer jq_set_error_cb hands back,
+	// and errBuf accumulates the messages jq reports through it while
+	// compiling or running.
+	errHandle cgo.Handle
+	errBuf    []string
+}
+
+func (p *Program) setLibPath(path string) {
+	if path == "" {
+		return
+	}
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	cAttr := C.CString("JQ_LIBRARY_PATH")
+	defer C.free(unsafe.Pointer(cAttr))
+	paths := C.jv_array_append(C.jv_array(), C.jv_string(cPath))
+	C.jq_set_attr(p.state, C.jv_string(cAttr), paths)
+}
+
+// Run applies the compiled program to a single JSON input and returns
+// the first output value it produces.
+func (p *Program) Run(input string) (string, error) {
+	if p.compileErr != nil {
+		return "", p.compileErr
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cInput := C.CString(input)
+	defer C.free(unsafe.Pointer(cInput))
+
+	value := C.jv_parse(cInput)
+	if C.jv_is_valid(value) == 0 {
+		C.jv_free(value)
+		return "", &JqError{Kind: JqErrorKindParse, Message: fmt.Sprintf("invalid JSON input: %s", input), Program: p.program}
+	}
+
+	p.resetHalted()
+	C.jq_start(p.state, value, 0)
+	result := C.jq_next(p.state)
+	if C.jv_is_valid(result) == 0 {
+		return "", p.resultError(result, input)
+	}
+	defer C.jv_free(result)
+
+	dumped := C.jv_dump_string(C.jv_copy(result), 0)
+	defer C.jv_free(dumped)
+	return C.GoString(C.jv_string_value(dumped)), nil
+}
+
+// RunValue marshals in to JSON to use as input and unmarshals the first
+// output value the program produces back into a Go value, so callers
+// don't have to hand-roll the encoding/json round-trip around Run.
+func (p *Program) RunValue(in interface{}) (interface{}, error) {
+	var out interface{}
+	if err := p.runInto(in, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RunInto marshals in to JSON to use as input and unmarshals the first
+// output value the program produces into out, which must be a pointer
+// as with json.Unmarshal.
+func (p *Program) RunInto(in interface{}, out interface{}) error {
+	return p.runInto(in, out)
+}
+
+func (p *Program) runInto(in interface{}, out interface{}) error {
+	input, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("jq: failed to marshal input: %w", err)
+	}
+
+	result, err := p.Run(string(input))
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(strings.NewReader(result))
+	if p.useNumber {
+		dec.UseNumber()
+	}
+	if err := dec.Decode(out); err != nil {
+		return fmt.Errorf("jq: failed to decode output: %w", err)
+	}
+	return nil
+}
+
+// RunAll applies the compiled program to a single JSON input and
+// returns every output value it produces, in order. Unlike Run, a
+// filter like `.[]` or `range(10)` yields all of its values instead of
+// just the first.
+func (p *Program) RunAll(input string) ([]string, error) {
+	if p.compileErr != nil {
+		return nil, p.compileErr
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cInput := C.CString(input)
+	defer C.free(unsafe.Pointer(cInput))
+
+	value := C.jv_parse(cInput)
+	if C.jv_is_valid(value) == 0 {
+		C.jv_free(value)
+		return nil, &JqError{Kind: JqErrorKindParse, Message: fmt.Sprintf("invalid JSON input: %s", input), Program: p.program}
+	}
+
+	p.resetHalted()
+	C.jq_start(p.state, value, 0)
+	return p.pump(nil)
+}
+
+// RunContext is like Run, but stops waiting as soon as ctx is done
+// instead of blocking until the program produces its first output. A
+// watcher goroutine calls jq_halt on the underlying jq_state once ctx
+// is cancelled, so an in-flight jq_next returns promptly instead of
+// leaving the calling goroutine - and any OS thread it locked via
+// runtime.LockOSThread - blocked in cgo for the life of the process.
+//
+// The watcher is started only once this call has acquired p.mu and
+// called jq_start, and is stopped before p.mu is released. Starting it
+// any earlier would let a ctx that merely expires while this call is
+// still waiting on a Program shared with another in-flight call halt
+// that unrelated call's jq_state instead of this one's.
+func (p *Program) RunContext(ctx context.Context, input string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	if p.compileErr != nil {
+		return "", p.compileErr
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cInput := C.CString(input)
+	defer C.free(unsafe.Pointer(cInput))
+
+	value := C.jv_parse(cInput)
+	if C.jv_is_valid(value) == 0 {
+		C.jv_free(value)
+		return "", &JqError{Kind: JqErrorKindParse, Message: fmt.Sprintf("invalid JSON input: %s", input), Program: p.program}
+	}
+
+	gen := p.resetHalted()
+	C.jq_start(p.state, value, 0)
+
+	stop := p.watchContext(ctx, gen)
+	defer stop()
+
+	result := C.jq_next(p.state)
+	if C.jv_is_valid(result) == 0 {
+		err := p.resultError(result, input)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+	defer C.jv_free(result)
+
+	dumped := C.jv_dump_string(C.jv_copy(result), 0)
+	defer C.jv_free(dumped)
+	return C.GoString(C.jv_string_value(dumped)), nil
+}
+
+// RunAllContext is the RunAll counterpart of RunContext. In addition to
+// the jq_halt triggered by a cancelled ctx, the result-pump loop itself
+// checks ctx between every output value, so a filter already partway
+// through producing a large number of outputs stops promptly too.
+//
+// As with RunContext, the watcher is started only once this call has
+// acquired p.mu and called jq_start, and is stopped before p.mu is
+// released, so a ctx that expires while this call is still waiting on
+// a Program shared with another in-flight call can't halt that
+// unrelated call's jq_state.
+func (p *Program) RunAllContext(ctx context.Context, input string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if p.compileErr != nil {
+		return nil, p.compileErr
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cInput := C.CString(input)
+	defer C.free(unsafe.Pointer(cInput))
+
+	value := C.jv_parse(cInput)
+	if C.jv_is_valid(value) == 0 {
+		C.jv_free(value)
+		return nil, &JqError{Kind: JqErrorKindParse, Message: fmt.Sprintf("invalid JSON input: %s", input), Program: p.program}
+	}
+
+	gen := p.resetHalted()
+	C.jq_start(p.state, value, 0)
+
+	stop := p.watchContext(ctx, gen)
+	defer stop()
+
+	results, err := p.pump(ctx)
+	if err != nil && ctx.Err() != nil {
+		return results, ctx.Err()
+	}
+	return results, err
+}
+
+// watchContext starts a goroutine that halts the Program's jq_state if
+// ctx is cancelled before the returned stop function is called. gen must
+// be the value resetHalted returned for the jq_start this watcher is
+// guarding, so halt can tell this watcher apart from one left over from
+// an earlier call on the same Program.
+//
+// Callers must always call stop once the run they guarded has finished,
+// whether it succeeded, failed, or was itself cancelled - and, crucially,
+// while still holding p.mu, since stop blocks until the watcher goroutine
+// has actually exited rather than merely signalling it to. Closing done
+// without waiting wouldn't be enough: if ctx happens to expire around the
+// same time stop is called, the watcher's select could still pick the
+// ctx.Done() case over done, and without this wait it could go on to call
+// halt after stop returns - possibly once a later call has already reused
+// this same Program and is running its own jq_start.
+func (p *Program) watchContext(ctx context.Context, gen uint64) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			p.halt(gen)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// halt asks the underlying jq_state to stop running at its next
+// opportunity, analogous to jq's own `halt_error`, but only if gen still
+// matches the generation resetHalted most recently produced. It
+// deliberately does not take p.mu: it's meant to be called from
+// watchContext's goroutine while a RunContext/RunAllContext call on the
+// same Program is blocked inside cgo holding that lock, so taking it here
+// would just wait out the very call halt is supposed to interrupt.
+//
+// The generation check matters because closing watchContext's done
+// channel doesn't guarantee its goroutine notices before returning: if
+// that goroutine is still scheduled to run when a new call reuses this
+// cached Program, it could otherwise halt the new call's jq_state
+// instead of the one it actually watched. Comparing against haltGen
+// catches that case even though jq_halt asserts the state isn't already
+// halted and aborts the whole process if it is, so halt also still
+// checks-and-sets halted under the same haltMu lock.
+func (p *Program) halt(gen uint64) {
+	p.haltMu.Lock()
+	defer p.haltMu.Unlock()
+	if p.state == nil || p.halted || p.haltGen != gen {
+		return
+	}
+	p.halted = true
+	C.jq_halt(p.state, C.jv_number(1), C.jv_invalid())
+}
+
+// resetHalted clears the halted flag halt checks and bumps haltGen,
+// mirroring the reset jq_start performs on the underlying jq_state's own
+// halted flag. It must be called under p.mu immediately before each
+// jq_start, so a halt left over from a previous run on this Program
+// doesn't make halt skip the very next run as already halted, and
+// returns the new generation for RunContext/
+// RunAllContext to hand to watchContext.
+func (p *Program) resetHalted() uint64 {
+	p.haltMu.Lock()
+	p.halted = false
+	p.haltGen++
+	gen := p.haltGen
+	p.haltMu.Unlock()
+	return gen
+}
+
+// pump drains jq_next until it yields JV_KIND_INVALID, collecting every
+// valid result as a dumped JSON string. It must be called with p.mu
+// held and after jq_start has been called on the current input. If ctx
+// is non-nil, pump checks it between every jq_next call and stops
+// early with ctx.Err() once it's done, in addition to the jq_halt a
+// caller may have triggered via watchContext.
+func (p *Program) pump(ctx context.Context) ([]string, error) {
+	var results []string
+	for {
+		if ctx != nil {
+			if err := ctx.Err(); err != nil {
+				return results, err
+			}
+		}
+
+		result := C.jq_next(p.state)
+		if C.jv_is_valid(result) == 0 {
+			if C.jv_invalid_has_msg(C.jv_copy(result)) != 0 || C.jq_halted(p.state) != 0 {
+				return results, p.resultError(result, "")
+			}
+			C.jv_free(result)
+			break
+		}
+
+		dumped := C.jv_dump_string(result, 0)
+		results = append(results, C.GoString(C.jv_string_value(dumped)))
+		C.jv_free(dumped)
+	}
+	return results, nil
+}
+
+// resultError turns a jq_next result already known to be invalid into a
+// JqError: a Halt if the program called halt/halt_error (checked via
+// jq_halted, with the exit code it set pulled from jq_get_exit_code), a
+// Runtime error if jq attached a message to the invalid result (e.g.
+// `error("boom")`), or a generic "no output" Runtime error otherwise.
+// input is included in the message for callers that know which input
+// produced it and is empty from pump, which is already mid-stream.
+func (p *Program) resultError(result C.jv, input string) error {
+	// jq_halted must be checked regardless of whether the invalid result
+	// carries a message: halt_error with no arguments halts the state
+	// without attaching one, so a message-only check would mistake it
+	// for a plain end of output.
+	halted := C.jq_halted(p.state) != 0
+
+	var message string
+	if C.jv_invalid_has_msg(C.jv_copy(result)) != 0 {
+		msg := C.jv_invalid_get_msg(result)
+		defer C.jv_free(msg)
+		message = C.GoString(C.jv_string_value(msg))
+	} else {
+		C.jv_free(result)
+	}
+
+	if halted {
+		// A plain `halt` sets no numeric exit code; report it as 0, as the
+		// jq CLI does.
+		exitCode := 0
+		code := C.jq_get_exit_code(p.state)
+		if C.jv_get_kind(code) == C.JV_KIND_NUMBER {
+			exitCode = int(C.jv_number_value(code))
+		}
+		C.jv_free(code)
+		return &JqError{Kind: JqErrorKindHalt, Message: message, Program: p.program, ExitCode: exitCode}
+	}
+
+	if message == "" {
+		message = "program produced no output"
+		if input != "" {
+			message = fmt.Sprintf("%s for input: %s", message, input)
+		}
+	}
+	return &JqError{Kind: JqErrorKindRuntime, Message: message, Program: p.program}
+}
+
+// RunStream applies the compiled program to the single JSON value read
+// from in and invokes out with each output value as it is produced, in
+// order. in may only contain one JSON document: it is read in full and
+// parsed with a single jv_parse, so a reader with more than one JSON
+// value back to back fails with a parse error rather than running the
+// program once per value. It's the streaming-output counterpart to
+// RunAll, not a streaming-input one - results are delivered as they
+// come off jq_next rather than collected into a slice, so a filter that
+// produces a very large or unbounded number of outputs doesn't have to
+// be buffered in memory.
+//
+// out's return value, if non-nil, stops the stream early and is returned
+// from RunStream unchanged.
+func (p *Program) RunStream(in io.Reader, out func(result string) error) error {
+	if p.compileErr != nil {
+		return p.compileErr
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	raw, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("jq: failed to read input: %w", err)
+	}
+
+	cInput := C.CString(string(raw))
+	defer C.free(unsafe.Pointer(cInput))
+
+	value := C.jv_parse(cInput)
+	if C.jv_is_valid(value) == 0 {
+		C.jv_free(value)
+		return &JqError{Kind: JqErrorKindParse, Message: "invalid JSON input", Program: p.program}
+	}
+
+	p.resetHalted()
+	C.jq_start(p.state, value, 0)
+
+	for {
+		result := C.jq_next(p.state)
+		if C.jv_is_valid(result) == 0 {
+			if C.jv_invalid_has_msg(C.jv_copy(result)) != 0 || C.jq_halted(p.state) != 0 {
+				return p.resultError(result, "")
+			}
+			C.jv_free(result)
+			return nil
+		}
+
+		dumped := C.jv_dump_string(result, 0)
+		str := C.GoString(C.jv_string_value(dumped))
+		C.jv_free(dumped)
+
+		if err := out(str); err != nil {
+			return err
+		}
+	}
+}
+
+// maxLineSize caps how large a single NDJSON line RunLines/RunLinesFunc
+// will buffer, well above what a line-delimited JSON record is expected
+// to need but still bounded so a malformed, newline-free input can't
+// grow the buffer without limit.
+const maxLineSize = 8 * 1024 * 1024
+
+// RunLines applies the compiled program to r, one line-delimited JSON
+// document at a time, writing every output value produced for each
+// line as its own line to w, matching `jq -c` on NDJSON input. A
+// failing line is skipped unless WithStopOnError was set on the
+// builder that produced this Program.
+func (p *Program) RunLines(r io.Reader, w io.Writer) error {
+	return p.RunLinesFunc(r, func(_ int, results []string, err error) error {
+		if err != nil {
+			return nil
+		}
+		for _, result := range results {
+			if _, err := fmt.Fprintln(w, result); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RunLinesFunc is like RunLines, but calls fn with each line's 1-based
+// line number, output values, and error instead of writing to an
+// io.Writer. Blank lines are skipped without calling fn. A line that
+// fails to parse or raises a runtime error does not by itself stop the
+// batch, unless WithStopOnError was set on the builder that produced
+// this Program; fn's own return value, if non-nil, always stops the
+// batch and is returned from RunLinesFunc unchanged.
+func (p *Program) RunLinesFunc(r io.Reader, fn func(line int, results []string, err error) error) error {
+	if p.compileErr != nil {
+		return p.compileErr
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		results, err := p.RunAll(line)
+		if cbErr := fn(lineNum, results, err); cbErr != nil {
+			return cbErr
+		}
+		if err != nil && p.stopOnError {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Close tears down the underlying jq_state. A Program that Cached took
+// from an attached Cache is owned by that Cache and must not be closed
+// directly.
+func (p *Program) Close() {
+	if p.state == nil {
+		return
+	}
+	C.jq_teardown(&p.state)
+	p.state = nil
+	p.errHandle.Delete()
+}
+
+// JqErrorKind distinguishes the stage of a JqError: compiling the
+// program text, parsing the JSON input, evaluating the compiled
+// program, or the program halting itself.
+type JqErrorKind int
+
+const (
+	// JqErrorKindCompile means the program text failed to compile;
+	// Line and Column, when jq's diagnostics included them, point at
+	// the offending token in Program.
+	JqErrorKindCompile JqErrorKind = iota
+	// JqErrorKindParse means the input passed to Run/RunAll/RunStream,
+	// or a value bound with WithArgJSON, was not valid JSON.
+	JqErrorKindParse
+	// JqErrorKindRuntime means the compiled program raised an error
+	// while running, e.g. `error("boom")` or an operation jq can't
+	// perform on the given input.
+	JqErrorKindRuntime
+	// JqErrorKindHalt means the program called halt or halt_error;
+	// ExitCode carries the code it halted with.
+	JqErrorKindHalt
+)
+
+func (k JqErrorKind) String() string {
+	switch k {
+	case JqErrorKindCompile:
+		return "compile"
+	case JqErrorKindParse:
+		return "parse"
+	case JqErrorKindRuntime:
+		return "runtime"
+	case JqErrorKindHalt:
+		return "halt"
+	default:
+		return "unknown"
+	}
+}
+
+// JqError is returned by Precompile, Run, RunAll and their variants for
+// every failure that originates from jq itself (as opposed to, say, a
+// failure to marshal a Go value before handing it to Run). Kind tells
+// callers which stage failed; Line and Column are only populated for
+// JqErrorKindCompile, and ExitCode only for JqErrorKindHalt.
+type JqError struct {
+	Kind     JqErrorKind
+	Message  string
+	Program  string
+	Line     int
+	Column   int
+	ExitCode int
+	Cause    error
+}
+
+func (e *JqError) Error() string {
+	switch e.Kind {
+	case JqErrorKindCompile:
+		if e.Line > 0 {
+			return fmt.Sprintf("jq: compile error at line %d: %s", e.Line, e.Message)
+		}
+		return fmt.Sprintf("jq: compile error: %s", e.Message)
+	case JqErrorKindParse:
+		return fmt.Sprintf("jq: %s", e.Message)
+	case JqErrorKindHalt:
+		return fmt.Sprintf("jq: halted with exit code %d: %s", e.ExitCode, e.Message)
+	default:
+		return fmt.Sprintf("jq: runtime error: %s", e.Message)
+	}
+}
+
+func (e *JqError) Unwrap() error {
+	return e.Cause
+}
+
+// parseLineColumn pulls a "line N" or "line N, column M" location out of
+// a jq compile diagnostic, returning zero values if none is present.
+// jq's own diagnostics don't always include a column.
+var lineColumnRe = regexp.MustCompile(`line (\d+)(?:, column (\d+))?`)
+
+func parseLineColumn(msg string) (line, column int) {
+	m := lineColumnRe.FindStringSubmatch(msg)
+	if m == nil {
+		return 0, 0
+	}
+	line, _ = strconv.Atoi(m[1])
+	if m[2] != "" {
+		column, _ = strconv.Atoi(m[2])
+	}
+	return line, column
+}
+
+// Cache stores compiled Programs keyed by cacheKey (program text, lib
+// path, builder flags and $arg bindings) so that repeated calls to Cached() for the same filter reuse one
+// jq_state instead of recompiling it. A Cache is safe for concurrent
+// use; Program.Run serializes concurrent evaluations of the same
+// compiled program.
+type Cache struct {
+	mu    sync.Mutex
+	items map[string]*Program
+}
+
+// NewCache returns an empty, unshared Cache.
+func NewCache() *Cache {
+	return &Cache{items: make(map[string]*Program)}
+}
+
+var (
+	defaultCacheOnce sync.Once
+	defaultCache     *Cache
+)
+
+// JqDefaultCache returns a process-wide Cache shared by every caller
+// that asks for it, so unrelated parts of a program can opt into
+// sharing compiled jq programs without explicitly passing a Cache
+// around.
+func JqDefaultCache() *Cache {
+	defaultCacheOnce.Do(func() {
+		defaultCache = NewCache()
+	})
+	return defaultCache
+}
+
+// getOrCompile returns the cached Program for key, compiling and
+// storing one via compile if it isn't present yet. A compile failure is
+// stored as-is (wrapped in a Program whose compileErr is set) so repeat
+// lookups don't keep retrying a filter that doesn't compile.
+func (c *Cache) getOrCompile(key string, compile func() (*Program, error)) *Program {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if prog, ok := c.items[key]; ok {
+		return prog
+	}
+
+	prog, err := compile()
+	if err != nil {
+		prog = &Program{compileErr: err}
+	}
+	c.items[key] = prog
+	return prog
+}
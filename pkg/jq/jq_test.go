@@ -1,6 +1,9 @@
 package jq
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"runtime"
 	"strings"
@@ -40,6 +43,166 @@ func Test_LibPath_FilteredFieldAccess(t *testing.T) {
 	g.Expect(res).To(Equal(out))
 }
 
+func Test_RunAll_MultipleOutputs(t *testing.T) {
+	g := NewWithT(t)
+
+	res, err := NewJq().Program(".[]").RunAll(`[1,2,3]`)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(res).To(Equal([]string{"1", "2", "3"}))
+}
+
+func Test_RunAll_InvalidInput(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := NewJq().Program(".").RunAll(`not json`)
+	g.Expect(err).Should(HaveOccurred())
+
+	var jqErr *JqError
+	g.Expect(errors.As(err, &jqErr)).To(BeTrue())
+	g.Expect(jqErr.Kind).To(Equal(JqErrorKindParse))
+}
+
+func Test_RunValue_Roundtrip(t *testing.T) {
+	g := NewWithT(t)
+
+	out, err := NewJq().Program(".foo").RunValue(map[string]interface{}{"foo": "bar"})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(out).To(Equal("bar"))
+}
+
+func Test_RunValue_MarshalError(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := NewJq().Program(".").RunValue(make(chan int))
+	g.Expect(err).Should(HaveOccurred())
+}
+
+func Test_RunInto_UseNumber(t *testing.T) {
+	g := NewWithT(t)
+
+	var out interface{}
+	err := NewJq().WithUseNumber().Program(".").RunInto(json.RawMessage(`1`), &out)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(out).To(BeAssignableToTypeOf(json.Number("")))
+}
+
+func Test_JqError_CompileError(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := NewJq().Program("this is not jq (((").Run("null")
+	g.Expect(err).Should(HaveOccurred())
+
+	var jqErr *JqError
+	g.Expect(errors.As(err, &jqErr)).To(BeTrue())
+	g.Expect(jqErr.Kind).To(Equal(JqErrorKindCompile))
+}
+
+func Test_JqError_RuntimeError(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := NewJq().Program(`error("boom")`).Run("null")
+	g.Expect(err).Should(HaveOccurred())
+
+	var jqErr *JqError
+	g.Expect(errors.As(err, &jqErr)).To(BeTrue())
+	g.Expect(jqErr.Kind).To(Equal(JqErrorKindRuntime))
+	g.Expect(jqErr.Message).To(Equal("boom"))
+}
+
+func Test_JqError_Halt(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := NewJq().Program("halt_error(3)").Run(`"boom"`)
+	g.Expect(err).Should(HaveOccurred())
+
+	var jqErr *JqError
+	g.Expect(errors.As(err, &jqErr)).To(BeTrue())
+	g.Expect(jqErr.Kind).To(Equal(JqErrorKindHalt))
+	g.Expect(jqErr.ExitCode).To(Equal(3))
+}
+
+func Test_RunLines_NDJSON(t *testing.T) {
+	g := NewWithT(t)
+
+	in := strings.NewReader("{\"foo\":1}\n{\"foo\":2}\n")
+	var out strings.Builder
+	err := NewJq().Program(".foo").RunLines(in, &out)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(out.String()).To(Equal("1\n2\n"))
+}
+
+func Test_RunLinesFunc_WithStopOnError(t *testing.T) {
+	g := NewWithT(t)
+
+	in := strings.NewReader("{\"foo\":1}\nnot json\n{\"foo\":2}\n")
+	var seen []int
+	err := NewJq().WithStopOnError().Program(".foo").RunLinesFunc(in, func(line int, results []string, lineErr error) error {
+		seen = append(seen, line)
+		return nil
+	})
+	g.Expect(err).Should(HaveOccurred())
+	g.Expect(seen).To(Equal([]int{1, 2}))
+}
+
+func Test_WithArg_BindsString(t *testing.T) {
+	g := NewWithT(t)
+
+	res, err := NewJq().WithArg("foo", "bar").Program("$foo").Run("null")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(res).To(Equal(`"bar"`))
+}
+
+func Test_WithArgJSON_BindsParsedValue(t *testing.T) {
+	g := NewWithT(t)
+
+	res, err := NewJq().WithArgJSON("foo", `{"a":1}`).Program("$foo").Run("null")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(res).To(Equal(`{"a":1}`))
+}
+
+func Test_WithArgValue_MarshalError(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := NewJq().WithArgValue("foo", make(chan int)).Program("$foo").Run("null")
+	g.Expect(err).Should(HaveOccurred())
+}
+
+func Test_WithArgJSON_InvalidJSON(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := NewJq().WithArgJSON("foo", "not json").Program("$foo").Run("null")
+	g.Expect(err).Should(HaveOccurred())
+
+	var jqErr *JqError
+	g.Expect(errors.As(err, &jqErr)).To(BeTrue())
+	g.Expect(jqErr.Kind).To(Equal(JqErrorKindParse))
+}
+
+func Test_RunStream_MultipleOutputs(t *testing.T) {
+	g := NewWithT(t)
+
+	var results []string
+	err := NewJq().Program(".[]").RunStream(strings.NewReader(`[1,2,3]`), func(result string) error {
+		results = append(results, result)
+		return nil
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(results).To(Equal([]string{"1", "2", "3"}))
+}
+
+func Test_RunStream_StopsEarlyOnCallbackError(t *testing.T) {
+	g := NewWithT(t)
+
+	stopErr := errors.New("stop")
+	var results []string
+	err := NewJq().Program(".[]").RunStream(strings.NewReader(`[1,2,3]`), func(result string) error {
+		results = append(results, result)
+		return stopErr
+	})
+	g.Expect(err).To(Equal(stopErr))
+	g.Expect(results).To(Equal([]string{"1"}))
+}
+
 func Test_CachedProgram_FieldAccess(t *testing.T) {
 	g := NewWithT(t)
 
@@ -56,6 +219,27 @@ func Test_CachedProgram_FieldAccess(t *testing.T) {
 	}
 }
 
+// Test_CachedProgram_UseNumberNotShared guards a Cache keying bug: two
+// builders sharing a Cache but disagreeing on WithUseNumber must not
+// get back each other's compiled Program, or the second builder's
+// RunInto would silently ignore the json.Number decoding it asked for.
+func Test_CachedProgram_UseNumberNotShared(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := NewCache()
+	in := json.RawMessage(`1`)
+
+	var withoutUseNumber interface{}
+	err := NewJq().WithCache(cache).Program(".").Cached().RunInto(in, &withoutUseNumber)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(withoutUseNumber).To(BeAssignableToTypeOf(float64(0)))
+
+	var withUseNumber interface{}
+	err = NewJq().WithCache(cache).WithUseNumber().Program(".").Cached().RunInto(in, &withUseNumber)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(withUseNumber).To(BeAssignableToTypeOf(json.Number("")))
+}
+
 func Test_Concurrent_FieldAccess(t *testing.T) {
 	g := NewWithT(t)
 
@@ -91,6 +275,90 @@ func Test_Concurrent_FieldAccess(t *testing.T) {
 	wg.Wait()
 }
 
+func Test_RunContext_Timeout(t *testing.T) {
+	g := NewWithT(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	_, err := NewJq().Program("def wait: reduce range(100000000) as $i (0; .+1); wait").RunContext(ctx, "null")
+	g.Expect(err).Should(HaveOccurred())
+}
+
+func Test_RunContext_Success(t *testing.T) {
+	g := NewWithT(t)
+
+	res, err := NewJq().Program(".foo").RunContext(context.Background(), `{"foo":"baz"}`)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(res).To(Equal(`"baz"`))
+}
+
+// Test_RunContext_ConcurrentHaltDoesNotCrash guards against a jq_halt
+// double-call: jq asserts the state isn't already halted and aborts the
+// whole process if it is, so two overlapping RunContext calls sharing a
+// precompiled Program must never let their watchContext goroutines both call
+// jq_halt on the same jq_state.
+func Test_RunContext_ConcurrentHaltDoesNotCrash(t *testing.T) {
+	prog, err := NewJq().Program(".").Precompile()
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	defer prog.Close()
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Microsecond)
+				_, _ = prog.RunContext(ctx, "null")
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Test_RunContext_CancelDoesNotHaltUnrelatedCall guards against a subtler
+// bug than the SIGABRT above: a ctx that merely expires while a call is
+// still waiting on a Program shared with another, already in-flight call
+// must not halt that unrelated call's jq_state. Before watchContext was
+// changed to start only once its own call has acquired prog's lock and
+// called jq_start, a short-lived ctx could do exactly that while queued
+// behind the slow call below.
+func Test_RunContext_CancelDoesNotHaltUnrelatedCall(t *testing.T) {
+	g := NewWithT(t)
+
+	prog, err := NewJq().Program("def wait: reduce range(20000000) as $i (0; .+1); wait").Precompile()
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	defer prog.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	var longErr error
+	go func() {
+		defer wg.Done()
+		_, longErr = prog.RunContext(context.Background(), "null")
+	}()
+
+	go func() {
+		defer wg.Done()
+		time.Sleep(time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Microsecond)
+		defer cancel()
+		_, _ = prog.RunContext(ctx, "null")
+	}()
+
+	wg.Wait()
+	g.Expect(longErr).ShouldNot(HaveOccurred())
+}
+
 // NOTE 02.02.2020  This test crashes with SIGABRT and trace when use jq from master
 // jq and oniguruma are downgraded to jq-1.6 tag
 //